@@ -0,0 +1,163 @@
+package singularity
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+/*** DNS-over-TLS / DNS-over-HTTPS Stuff ***/
+
+// dohMediaType is the RFC 8484 content type used to exchange DNS
+// messages in wire format over HTTP.
+const dohMediaType = "application/dns-message"
+
+// NewDoTServer configures a DNS-over-TLS (RFC 7858) listener that
+// answers queries with handler, exactly like the plaintext DNS server
+// started by the caller with Net: "udp"/"tcp".
+func NewDoTServer(addr string, tlsConfig *tls.Config, handler dns.Handler) *dns.Server {
+	return &dns.Server{
+		Addr:      addr,
+		Net:       "tcp-tls",
+		TLSConfig: tlsConfig,
+		Handler:   handler,
+	}
+}
+
+// StartDoTServer loads the certificate/key pair at appConfig.TLSCertFile
+// and appConfig.TLSKeyFile and starts a DoT listener on
+// appConfig.DoTAddr, answering queries with MakeRebindDNSHandler
+// exactly like the plaintext DNS server. It is a no-op, returning
+// (nil, nil), when DoTAddr is empty, mirroring how NewHTTPServer only
+// wires up DoH when DoHPath is set.
+func StartDoTServer(appConfig *AppConfig, dcss *DNSClientStateStore) (*dns.Server, error) {
+	if appConfig == nil || appConfig.DoTAddr == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(appConfig.TLSCertFile, appConfig.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("DoT: loading TLS cert/key: %w", err)
+	}
+
+	server := NewDoTServer(appConfig.DoTAddr, &tls.Config{Certificates: []tls.Certificate{cert}}, MakeRebindDNSHandler(appConfig, dcss))
+
+	go func() {
+		log.Printf("DNS: starting DoT server on %v\n", appConfig.DoTAddr)
+		if err := server.ListenAndServe(); err != nil {
+			log.Printf("DNS: DoT server on %v stopped: %v\n", appConfig.DoTAddr, err)
+		}
+	}()
+
+	return server, nil
+}
+
+// DoHHandler implements a DNS-over-HTTPS (RFC 8484) front-end. It
+// accepts both the GET ?dns= (base64url, no padding) and POST
+// application/dns-message forms, decodes the wire-format query,
+// answers it by running it through Handler via an in-memory
+// dns.ResponseWriter, and writes the wire-format reply back.
+type DoHHandler struct {
+	Handler dns.Handler
+}
+
+func (h *DoHHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("HTTP: %v %v from %v", r.Method, r.RequestURI, r.RemoteAddr)
+
+	var wire []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		encoded := r.URL.Query().Get("dns")
+		if encoded == "" {
+			http.Error(w, "missing dns query parameter", http.StatusBadRequest)
+			return
+		}
+		wire, err = base64.RawURLEncoding.DecodeString(encoded)
+
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		wire, err = ioutil.ReadAll(r.Body)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, "malformed DNS query", http.StatusBadRequest)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(wire); err != nil {
+		http.Error(w, "malformed DNS query", http.StatusBadRequest)
+		return
+	}
+
+	rw := newDoHResponseWriter(r)
+	h.Handler.ServeDNS(rw, req)
+
+	if rw.msg == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := rw.msg.Pack()
+	if err != nil {
+		http.Error(w, "failed to encode DNS response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohMediaType)
+	w.Write(resp)
+}
+
+// dohResponseWriter adapts a single DoH HTTP request/response pair to
+// the dns.ResponseWriter interface, so DoH requests can be answered by
+// the same dns.HandlerFunc used by the plaintext and DoT DNS servers.
+type dohResponseWriter struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	msg        *dns.Msg
+}
+
+func newDoHResponseWriter(r *http.Request) *dohResponseWriter {
+	remoteAddr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		remoteAddr = &net.TCPAddr{}
+	}
+	return &dohResponseWriter{localAddr: &net.TCPAddr{}, remoteAddr: remoteAddr}
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return w.localAddr }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remoteAddr }
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
@@ -0,0 +1,159 @@
+package singularity
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// echoHandler replies to every query with a fixed A record, just
+// enough for DoHHandler's round trip through a dns.Handler to be
+// observable.
+var echoHandler = dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	rr, _ := dns.NewRR("example.com. 0 IN A 198.51.100.1")
+	m.Answer = append(m.Answer, rr)
+	w.WriteMsg(m)
+})
+
+func packedQuery(t *testing.T) []byte {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	wire, err := q.Pack()
+	if err != nil {
+		t.Fatalf("packing query: %v", err)
+	}
+	return wire
+}
+
+// TestDoHHandlerPOST exercises the POST application/dns-message form
+// end-to-end: a packed query in, the handler's reply unpacked back out.
+func TestDoHHandlerPOST(t *testing.T) {
+	h := &DoHHandler{Handler: echoHandler}
+
+	req := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(packedQuery(t)))
+	req.Header.Set("Content-Type", dohMediaType)
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200; body: %s", rec.Code, rec.Body.String())
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(rec.Body.Bytes()); err != nil {
+		t.Fatalf("unpacking response: %v", err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "198.51.100.1" {
+		t.Errorf("Answer = %v, want one A record for 198.51.100.1", resp.Answer)
+	}
+}
+
+// TestDoHHandlerGET exercises the GET ?dns= base64url form.
+func TestDoHHandlerGET(t *testing.T) {
+	h := &DoHHandler{Handler: echoHandler}
+
+	encoded := base64.RawURLEncoding.EncodeToString(packedQuery(t))
+	req := httptest.NewRequest(http.MethodGet, "/dns-query?dns="+encoded, nil)
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200; body: %s", rec.Code, rec.Body.String())
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(rec.Body.Bytes()); err != nil {
+		t.Fatalf("unpacking response: %v", err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "198.51.100.1" {
+		t.Errorf("Answer = %v, want one A record for 198.51.100.1", resp.Answer)
+	}
+}
+
+// TestDoHHandlerMalformed covers every way a request can fail to
+// decode into a usable DNS query, each of which must produce a 4xx
+// error rather than a panic or a 500.
+func TestDoHHandlerMalformed(t *testing.T) {
+	h := &DoHHandler{Handler: echoHandler}
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		body        []byte
+		contentType string
+		wantStatus  int
+	}{
+		{
+			name:       "GET missing dns param",
+			method:     http.MethodGet,
+			target:     "/dns-query",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "GET invalid base64",
+			method:     http.MethodGet,
+			target:     "/dns-query?dns=not-valid-base64!!",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "GET valid base64 but not a DNS message",
+			method:     http.MethodGet,
+			target:     "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString([]byte("not a dns message")),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:        "POST wrong content type",
+			method:      http.MethodPost,
+			target:      "/dns-query",
+			body:        packedQuery(t),
+			contentType: "application/octet-stream",
+			wantStatus:  http.StatusUnsupportedMediaType,
+		},
+		{
+			name:        "POST body not a DNS message",
+			method:      http.MethodPost,
+			target:      "/dns-query",
+			body:        []byte("not a dns message"),
+			contentType: dohMediaType,
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:       "unsupported method",
+			method:     http.MethodPut,
+			target:     "/dns-query",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body *bytes.Reader
+			if tt.body != nil {
+				body = bytes.NewReader(tt.body)
+			} else {
+				body = bytes.NewReader(nil)
+			}
+			req := httptest.NewRequest(tt.method, tt.target, body)
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d; body: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+}
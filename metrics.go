@@ -0,0 +1,166 @@
+package singularity
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+/*** Prometheus Metrics ***/
+
+var (
+	// dnsQueriesTotal counts DNS queries handled by MakeRebindDNSHandler,
+	// broken down by query type, the strategy that answered it, and the
+	// resulting rcode.
+	dnsQueriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "singularity_dns_queries_total",
+		Help: "Total number of DNS queries handled, by qtype, strategy and rcode.",
+	}, []string{"qtype", "strategy", "rcode"})
+
+	// dnsRebindLatencySeconds observes the time between a session's
+	// previous and current query, i.e. how quickly a client re-resolves
+	// after the rebind window opens.
+	dnsRebindLatencySeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "singularity_dns_rebind_latency_seconds",
+		Help:    "Time between successive queries for the same DNS rebinding session.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	// iptablesRulesTotal counts iptables rules added/removed by
+	// IPTablesHandler, by action.
+	iptablesRulesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "singularity_iptables_rules_total",
+		Help: "Total number of iptables rules added or removed, by action.",
+	}, []string{"action"})
+
+	// httpServerUp reports whether an HTTP server on a given address is
+	// currently serving (1) or stopped (0).
+	httpServerUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "singularity_http_server_up",
+		Help: "Whether a Singularity HTTP server is currently serving, by address.",
+	}, []string{"addr"})
+)
+
+func init() {
+	prometheus.MustRegister(dnsQueriesTotal, dnsRebindLatencySeconds, iptablesRulesTotal, httpServerUp)
+}
+
+// observeQuery records a DNS query in dnsQueriesTotal and, when prevQueryTime
+// is non-zero (i.e. this is not the session's first query), the time since
+// that previous query in dnsRebindLatencySeconds.
+func observeQuery(qtype, strategy, rcode string, now, prevQueryTime time.Time) {
+	dnsQueriesTotal.WithLabelValues(qtype, strategy, rcode).Inc()
+
+	if !prevQueryTime.IsZero() {
+		dnsRebindLatencySeconds.Observe(now.Sub(prevQueryTime).Seconds())
+	}
+}
+
+// sessionsGauge and sessionsGaugeStore track the currently registered
+// singularity_dns_sessions collector and the store it reads from, so
+// registerSessionsGauge can be called every time an HTTP server is
+// (re)started without registering the same collector with the default
+// registry twice. Unlike a registered-once-per-store guard, swapping
+// the collector on a store change means a second, distinct store in
+// the same process replaces the metric instead of panicking on
+// prometheus.MustRegister with a duplicate metric name. sessionsGaugeMu
+// guards the whole check-unregister-register-store sequence so that
+// concurrent callers (e.g. multiple configured HTTPServerPorts starting
+// at once) can't both pass the dcss check and both register.
+var (
+	sessionsGaugeMu    sync.Mutex
+	sessionsGauge      prometheus.Collector
+	sessionsGaugeStore *DNSClientStateStore
+)
+
+func registerSessionsGauge(dcss *DNSClientStateStore) {
+	sessionsGaugeMu.Lock()
+	defer sessionsGaugeMu.Unlock()
+
+	if sessionsGaugeStore == dcss {
+		return
+	}
+
+	if sessionsGauge != nil {
+		prometheus.Unregister(sessionsGauge)
+	}
+
+	sessionsGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "singularity_dns_sessions",
+		Help: "Current number of live DNS rebinding sessions.",
+	}, func() float64 {
+		dcss.RLock()
+		defer dcss.RUnlock()
+		return float64(len(dcss.Sessions))
+	})
+	prometheus.MustRegister(sessionsGauge)
+	sessionsGaugeStore = dcss
+}
+
+// SessionsHandler serves a JSON snapshot of a DNSClientStateStore's
+// sessions at GET /sessions, and force-expires a single session at
+// DELETE /sessions/{id}, so operators can watch or steer an in-progress
+// attack from the browser UI or curl.
+type SessionsHandler struct {
+	Dcss *DNSClientStateStore
+}
+
+func (h *SessionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("HTTP: %v %v from %v", r.Method, r.RequestURI, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	switch r.Method {
+	case "GET":
+		h.Dcss.RLock()
+		sessions := make(map[string]DNSClientState, len(h.Dcss.Sessions))
+		for id, state := range h.Dcss.Sessions {
+			sessions[id] = *state
+		}
+		s, err := json.Marshal(sessions)
+		h.Dcss.RUnlock()
+
+		if err != nil {
+			http.Error(w, "{}", 500)
+			return
+		}
+
+		fmt.Fprintf(w, "%v", string(s))
+
+	case "DELETE":
+		id := strings.TrimPrefix(r.URL.Path, "/sessions/")
+		if id == "" || id == r.URL.Path {
+			http.Error(w, "{}", 400)
+			return
+		}
+
+		h.Dcss.Lock()
+		_, ok := h.Dcss.Sessions[id]
+		delete(h.Dcss.Sessions, id)
+		h.Dcss.Unlock()
+
+		if !ok {
+			http.Error(w, "{}", 404)
+			return
+		}
+
+		fmt.Fprintf(w, "{}")
+
+	default:
+		http.Error(w, "{}", 400)
+	}
+}
+
+// metricsHandler returns the Prometheus /metrics handler, registering
+// dcss's live session gauge when called (see registerSessionsGauge).
+func metricsHandler(dcss *DNSClientStateStore) http.Handler {
+	registerSessionsGauge(dcss)
+	return promhttp.Handler()
+}
@@ -0,0 +1,22 @@
+package singularity
+
+import "testing"
+
+// TestRegisterSessionsGaugeSwapsStore guards against panicking when
+// registerSessionsGauge is called for a second, distinct
+// DNSClientStateStore in the same process: the collector must be
+// swapped rather than registered twice under the same metric name.
+func TestRegisterSessionsGaugeSwapsStore(t *testing.T) {
+	first := &DNSClientStateStore{Sessions: map[string]*DNSClientState{}}
+	second := &DNSClientStateStore{Sessions: map[string]*DNSClientState{"s": {}}}
+
+	registerSessionsGauge(first)
+	registerSessionsGauge(first) // same store again: must be a no-op, not a re-registration
+
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("registerSessionsGauge panicked on a second store: %v", r)
+		}
+	}()
+	registerSessionsGauge(second)
+}
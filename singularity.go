@@ -1,6 +1,7 @@
 package singularity
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -19,14 +20,6 @@ import (
 
 /*** General Stuff ***/
 
-//DNSRebindingStrategy maps a DNS Rebinding strategy name to a function
-var DNSRebindingStrategy = map[string]func(session string, dcss *DNSClientStateStore, q dns.Question) []string{
-	"fromqueryroundrobin":      DNSRebindFromQueryRoundRobin,
-	"fromqueryfirstthensecond": DNSRebindFromQueryFirstThenSecond,
-	"fromqueryrandom":          DNSRebindFromQueryRandom,
-	"fromquerymultia":          DNSRebindFromQueryMultiA,
-}
-
 // DNSClientStateStore stores DNS sessions
 // It permits to respond to multiple clients
 // based on their current DNS rebinding state.
@@ -46,6 +39,29 @@ type AppConfig struct {
 	RebindingFnName              string
 	ResponseReboundIPAddrtimeOut int
 	AllowDynamicHTTPServers      bool
+	// UpstreamResolvers lists DNS resolvers (host:port) used to answer
+	// queries that do not match the rebinding grammar, or that are
+	// neither A nor AAAA queries, so Singularity can be used as a host's
+	// only resolver.
+	UpstreamResolvers []string
+	// DoTAddr is the listen address (e.g. ":853") of the DNS-over-TLS
+	// front-end. Left empty, no DoT listener is started.
+	DoTAddr string
+	// DoHPath is the HTTP path (e.g. "/dns-query") the DNS-over-HTTPS
+	// front-end is served on. Left empty, no DoH endpoint is registered.
+	DoHPath string
+	// TLSCertFile and TLSKeyFile locate the certificate/key pair loaded
+	// by StartDoTServer for the DoT front-end. The DoH endpoint is served
+	// by NewHTTPServer's plain http.Server and does not use them.
+	TLSCertFile string
+	TLSKeyFile  string
+	// ECSAllowedCIDRs lists the client subnets (CIDR notation) allowed
+	// to receive the rebound IP under the fromqueryecsmatch strategy.
+	ECSAllowedCIDRs []string
+	// ResolverCountThreshold is the number of distinct resolver source
+	// addresses that must have queried a session before
+	// fromqueryresolvercount starts serving the rebound IP.
+	ResolverCountThreshold int
 }
 
 /*** DNS Stuff ***/
@@ -59,6 +75,23 @@ type DNSClientState struct {
 	LastResponseReboundIPAddr    int
 	ResponseReboundIPAddrtimeOut int
 	DNSCacheFlush                bool
+	// ECSSubnet is the client subnet (CIDR notation, e.g.
+	// "198.51.100.0/24") advertised via the EDNS0 Client Subnet option
+	// (RFC 7871) on the most recent query, if any.
+	ECSSubnet string
+	// ResolverAddrs tracks the distinct resolver source IPs
+	// (resolverIP(w.RemoteAddr()), i.e. without the source port) that
+	// have queried this session.
+	ResolverAddrs map[string]bool
+	// ResolverCountThreshold mirrors AppConfig.ResolverCountThreshold
+	// at the time of the last query.
+	ResolverCountThreshold int
+	// QueryCount counts how many times this session has been queried;
+	// used by strategies such as after-n-queries.
+	QueryCount int
+	// FirstQueryTime is when the session was first seen; used by
+	// strategies such as time-window.
+	FirstQueryTime time.Time
 }
 
 // ExpireOldEntries expire DNS Client Sessions
@@ -85,6 +118,59 @@ type DNSQuery struct {
 	DNSRebindingStrategy  string
 	DNSCacheFlush         bool
 	Domain                string
+	// StrategyParams holds the key=value pairs trailing the strategy
+	// name in the query, used to Configure a RebindStrategy.
+	StrategyParams map[string]string
+}
+
+// decodeDNSHost decodes a single host token from a DNS rebinding query.
+// A token is either "localhost", a dotted-decimal IPv4 literal, or an
+// IPv6 literal with every ":" replaced by "-" (":" being illegal in a
+// DNS label). It returns the host in its canonical form (colons
+// restored for IPv6) so callers can tell the address family apart with
+// a simple strings.Contains(addr, ":").
+func decodeDNSHost(token string) (string, error) {
+	if token == "localhost" {
+		return token, nil
+	}
+
+	if net.ParseIP(token) != nil { // IPv4 literal, or an IPv6 literal that slipped through undashed
+		return token, nil
+	}
+
+	if candidate := strings.Replace(token, "-", ":", -1); net.ParseIP(candidate) != nil {
+		return candidate, nil
+	}
+
+	return "", fmt.Errorf("cannot parse host %q in DNS query", token)
+}
+
+// splitDNSHosts splits the combined host1/host2 portion of a DNS
+// rebinding query into its two host tokens. IPv4 literals and
+// "localhost" never contain a "-", but a dashed IPv6 literal does, so a
+// single split on "-" is not enough to find the boundary between the
+// two hosts. Instead every "-" is tried as a candidate boundary until
+// both halves decode to a valid host.
+func splitDNSHosts(combined string) (first, second string, err error) {
+	for i, c := range combined {
+		if c != '-' {
+			continue
+		}
+
+		decodedFirst, errFirst := decodeDNSHost(combined[:i])
+		if errFirst != nil {
+			continue
+		}
+
+		decodedSecond, errSecond := decodeDNSHost(combined[i+1:])
+		if errSecond != nil {
+			continue
+		}
+
+		return decodedFirst, decodedSecond, nil
+	}
+
+	return "", "", errors.New("cannot parse hosts in DNS query")
 }
 
 // NewDNSQuery parses DNS query string
@@ -100,7 +186,7 @@ func NewDNSQuery(qname string) (*DNSQuery, error) {
 
 	head := split[0]
 
-	tail := strings.Split(head, "s-")
+	tail := strings.SplitN(head, "s-", 2)
 
 	if len(tail) == 1 {
 		return name, errors.New("cannot find start tag in DNS query")
@@ -114,38 +200,54 @@ func NewDNSQuery(qname string) (*DNSQuery, error) {
 		return name, errors.New("cannot parse domain in DNS query")
 	}
 
-	if len(elements) != 4 {
-		return name, errors.New("cannot parse DNS query")
+	// Trailing "key=value" elements configure the rebinding strategy
+	// (see RebindStrategy.Configure) and are not part of the fixed
+	// hosts/session/strategy layout.
+	name.StrategyParams = map[string]string{}
+	for len(elements) > 0 && strings.Contains(elements[len(elements)-1], "=") {
+		kv := strings.SplitN(elements[len(elements)-1], "=", 2)
+		if len(kv) == 2 {
+			name.StrategyParams[kv[0]] = kv[1]
+		}
+		elements = elements[:len(elements)-1]
 	}
 
-	if net.ParseIP(elements[0]) == nil {
-		return name, errors.New("cannot parse IP address of first host in DNS query")
-
+	// At least 4 elements: hosts, session and strategy. The hosts
+	// portion itself may contain extra "-" when either host is a
+	// dashed IPv6 literal, and the strategy name may too (e.g.
+	// "after-n-queries"), so the strategy is found before the hosts
+	// are split out.
+	if len(elements) < 4 {
+		return name, errors.New("cannot parse DNS query")
 	}
-	name.ResponseIPAddr = elements[0]
 
-	if elements[1] != "localhost" {
+	strategyName, elements, err := splitStrategyName(elements)
+	if err != nil {
+		return name, err
+	}
 
-		if net.ParseIP(elements[1]) == nil {
-			return name, errors.New("cannot parse IP address of second host in DNS query")
+	hosts := strings.Join(elements[:len(elements)-1], "-")
 
-		}
+	firstHost, secondHost, err := splitDNSHosts(hosts)
+	if err != nil {
+		return name, err
 	}
-	name.ResponseReboundIPAddr = elements[1]
+	name.ResponseIPAddr = firstHost
+	name.ResponseReboundIPAddr = secondHost
 
-	name.Session = elements[2]
+	name.Session = elements[len(elements)-1]
 
 	if len(name.Session) == 0 {
 		return name, errors.New("cannot parse session in DNS query")
 
 	}
 
-	/*if len(elements[3]) != 0 {
+	/*if len(elements[len(elements)-1]) != 0 {
 		name.DNSCacheFlush = true
 	}
 	*/
 
-	name.DNSRebindingStrategy = elements[3]
+	name.DNSRebindingStrategy = strategyName
 
 	name.Domain = fmt.Sprintf(".%v", domainSuffix)
 
@@ -246,6 +348,182 @@ func DNSRebindFromQueryMultiA(session string, dcss *DNSClientStateStore, q dns.Q
 	return answers
 }
 
+// resolverIP strips the source port off addr, returning just the IP.
+// Recursive resolvers randomize their UDP source port per query (RFC
+// 5452), so the port must not be part of the dedup key used to count
+// distinct resolvers in ResolverAddrs, or every query from the same
+// resolver would look like a new one.
+func resolverIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// DNSRebindFromQueryResolverCount is a response handler to DNS queries.
+// It keeps returning the safe (first) IP until N distinct resolver
+// source addresses have queried the session, N being
+// AppConfig.ResolverCountThreshold. This defeats recursive resolvers
+// that spread queries for the same name across a pool of downstream
+// servers to dodge single-resolver pinning defenses.
+func DNSRebindFromQueryResolverCount(session string, dcss *DNSClientStateStore, q dns.Question) []string {
+	dcss.RLock()
+	answers := []string{dcss.Sessions[session].ResponseIPAddr}
+	dnsCacheFlush := dcss.Sessions[session].DNSCacheFlush
+	resolverCount := len(dcss.Sessions[session].ResolverAddrs)
+	threshold := dcss.Sessions[session].ResolverCountThreshold
+
+	log.Printf("DNS: in DNSRebindFromQueryResolverCount\n")
+
+	if dnsCacheFlush == false { // This is not a request for cache eviction
+		if threshold > 0 && resolverCount >= threshold {
+			answers[0] = dcss.Sessions[session].ResponseReboundIPAddr
+		}
+	}
+	dcss.RUnlock()
+	return answers
+}
+
+// ecsMatchesAllowlist reports whether the client subnet ecsSubnet (a
+// CIDR string, as recorded on DNSClientState.ECSSubnet) falls inside
+// any of the operator-supplied CIDR allowlist entries.
+func ecsMatchesAllowlist(ecsSubnet string, allowedCIDRs []string) bool {
+	if ecsSubnet == "" {
+		return false
+	}
+
+	clientIP, _, err := net.ParseCIDR(ecsSubnet)
+	if err != nil {
+		return false
+	}
+
+	for _, cidr := range allowedCIDRs {
+		_, allowedNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		if allowedNet.Contains(clientIP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseECS extracts the RFC 7871 EDNS0 Client Subnet option from a DNS
+// query, if present, and returns it in CIDR notation.
+func parseECS(r *dns.Msg) string {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+
+	for _, o := range opt.Option {
+		subnet, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+		return fmt.Sprintf("%s/%d", subnet.Address.String(), subnet.SourceNetmask)
+	}
+
+	return ""
+}
+
+// echoECS mirrors the EDNS0 Client Subnet option found on query r onto
+// response m, with SourceScope set to SourceNetmask, so that
+// downstream resolvers cache the answer only for the intended client
+// scope (RFC 7871 §7.2.1).
+func echoECS(r, m *dns.Msg) {
+	reqOpt := r.IsEdns0()
+	if reqOpt == nil {
+		return
+	}
+
+	for _, o := range reqOpt.Option {
+		subnet, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+
+		respOpt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		respOpt.Option = append(respOpt.Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        subnet.Family,
+			SourceNetmask: subnet.SourceNetmask,
+			SourceScope:   subnet.SourceNetmask,
+			Address:       subnet.Address,
+		})
+		m.Extra = append(m.Extra, respOpt)
+		return
+	}
+}
+
+// addrMatchesQtype reports whether addr's address family satisfies
+// qtype: an IPv4 answer only satisfies an A query and an IPv6 answer
+// only satisfies an AAAA query. "localhost" always matches, since it
+// is served as a CNAME regardless of qtype.
+func addrMatchesQtype(addr string, qtype uint16) bool {
+	if addr == "localhost" {
+		return true
+	}
+
+	answerQtype := dns.TypeA
+	if strings.Contains(addr, ":") {
+		answerQtype = dns.TypeAAAA
+	}
+
+	return answerQtype == qtype
+}
+
+// dnsAnswerRR builds the resource record line for a single rebind
+// answer. ok is false when the answer's family does not match qtype,
+// in which case the caller should omit it, producing an empty NOERROR
+// rather than serving the wrong-family address.
+func dnsAnswerRR(qname string, qtype uint16, addr string, ttl int) (line string, ok bool) {
+	if !addrMatchesQtype(addr, qtype) {
+		return "", false
+	}
+
+	if addr == "localhost" {
+		return fmt.Sprintf("%s %d IN CNAME %s.", qname, ttl, addr), true
+	}
+
+	rrType := "A"
+	if strings.Contains(addr, ":") {
+		rrType = "AAAA"
+	}
+
+	return fmt.Sprintf("%s %d IN %s %s", qname, ttl, rrType, addr), true
+}
+
+// forwardUpstream relays a DNS query to the configured upstream resolvers,
+// trying each in order, and writes the first successful reply verbatim to
+// w. It picks UDP or TCP depending on how the client reached us, so that
+// truncated/TCP queries are relayed over TCP in turn. If every upstream
+// fails, it responds with SERVFAIL via dns.HandleFailed.
+func forwardUpstream(appConfig *AppConfig, w dns.ResponseWriter, r *dns.Msg) {
+	network := "udp"
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		network = "tcp"
+	}
+
+	c := &dns.Client{Net: network}
+
+	for _, upstream := range appConfig.UpstreamResolvers {
+		resp, _, err := c.Exchange(r, upstream)
+		if err != nil {
+			log.Printf("DNS: upstream %v failed: %v\n", upstream, err)
+			continue
+		}
+		w.WriteMsg(resp)
+		return
+	}
+
+	log.Printf("DNS: all upstream resolvers failed for query: %v\n", r.Question)
+	dns.HandleFailed(w, r)
+}
+
 // MakeRebindDNSHandler generates a DNS request handler
 // based on app settings.
 // This is the core DNS queries handling loop
@@ -254,7 +532,7 @@ func MakeRebindDNSHandler(appConfig *AppConfig, dcss *DNSClientStateStore) dns.H
 		name := &DNSQuery{}
 		clientState := &DNSClientState{}
 		now := time.Now()
-		rebindingFn := appConfig.RebindingFn
+		strategy := RebindStrategy(&legacyRebindStrategy{name: appConfig.RebindingFnName, fn: appConfig.RebindingFn})
 
 		m := new(dns.Msg)
 		m.SetReply(r)
@@ -264,80 +542,97 @@ func MakeRebindDNSHandler(appConfig *AppConfig, dcss *DNSClientStateStore) dns.H
 		case dns.OpcodeQuery:
 			for _, q := range m.Question {
 				switch q.Qtype {
-				case dns.TypeA:
-					log.Printf("DNS: Received A query: %v from: %v\n", q.Name, w.RemoteAddr().String())
+				case dns.TypeA, dns.TypeAAAA:
+					log.Printf("DNS: Received %v query: %v from: %v\n", dns.TypeToString[q.Qtype], q.Name, w.RemoteAddr().String())
 
 					// Preparing to update the client DNS query state
 					clientState.CurrentQueryTime = now
 					clientState.ResponseReboundIPAddrtimeOut = appConfig.ResponseReboundIPAddrtimeOut
 					clientState.DNSCacheFlush = false
+					clientState.ResolverCountThreshold = appConfig.ResolverCountThreshold
+
+					ecsSubnet := parseECS(r)
+					resolverAddr := resolverIP(w.RemoteAddr())
 
 					var err error
 					name, err = NewDNSQuery(q.Name)
 					log.Printf("DNS: Parsed query: %v, error: %v\n", name, err)
 
 					if err != nil {
+						if len(appConfig.UpstreamResolvers) > 0 {
+							// Not a rebinding query, let a real resolver answer it.
+							forwardUpstream(appConfig, w, r)
+							return
+						}
+
 						// We could not parse the query, set default response settings
 						clientState.ResponseIPAddr = appConfig.ResponseIPAddr
 						clientState.ResponseReboundIPAddr = appConfig.ResponseReboundIPAddr
 						// Strategy is to return clientState.ResponseIPAddr
-						rebindingFn = dnsRebindFirst
+						strategy = &legacyRebindStrategy{name: "dnsRebindFirst", fn: dnsRebindFirst}
 					} else {
 						clientState.ResponseIPAddr = name.ResponseIPAddr
 						clientState.ResponseReboundIPAddr = name.ResponseReboundIPAddr
 						clientState.DNSCacheFlush = name.DNSCacheFlush
-						if fn, ok := DNSRebindingStrategy[name.DNSRebindingStrategy]; ok {
-							rebindingFn = fn
+						if s, strategyErr := NewRebindStrategy(name.DNSRebindingStrategy, name.StrategyParams); strategyErr == nil {
+							strategy = s
 						}
 					}
 
 					_, keyExists := dcss.Sessions[name.Session]
 					log.Printf("DNS: session exists: %v\n", keyExists)
 
+					var prevQueryTime time.Time
 					dcss.Lock()
 					if keyExists != true {
 						// New session
+						clientState.ResolverAddrs = map[string]bool{resolverAddr: true}
+						clientState.FirstQueryTime = now
+						clientState.QueryCount = 1
 						dcss.Sessions[name.Session] = clientState
 					} else {
 						// Existing session
+						prevQueryTime = dcss.Sessions[name.Session].CurrentQueryTime
 						dcss.Sessions[name.Session].ResponseIPAddr = clientState.ResponseIPAddr
 						dcss.Sessions[name.Session].ResponseReboundIPAddr = clientState.ResponseReboundIPAddr
+						if dcss.Sessions[name.Session].ResolverAddrs == nil {
+							dcss.Sessions[name.Session].ResolverAddrs = map[string]bool{}
+						}
+						dcss.Sessions[name.Session].ResolverAddrs[resolverAddr] = true
+						dcss.Sessions[name.Session].QueryCount++
 					}
 					dcss.Sessions[name.Session].DNSCacheFlush = clientState.DNSCacheFlush
-					dcss.Unlock()
-
-					answers := rebindingFn(name.Session, dcss, q)
-
-					response := []string{}
-
-					if len(answers) == 1 { //we return only one answer
-
-						if answers[0] == "localhost" { //we respond with a CNAME record
-
-							response = append(response, fmt.Sprintf("%s 10 IN CNAME %s.", q.Name, answers[0]))
-
-						} else { // We respond with a A record
-							response = append(response, fmt.Sprintf("%s 0 IN A %s", q.Name, answers[0]))
-
-						}
-					} else { // We respond multiple answers
-						response = append(response, fmt.Sprintf("%s 10 IN A %s", q.Name, answers[0]))
-						response = append(response, fmt.Sprintf("%s 10 IN A %s", q.Name, answers[1]))
-
+					dcss.Sessions[name.Session].ResolverCountThreshold = clientState.ResolverCountThreshold
+					if ecsSubnet != "" {
+						dcss.Sessions[name.Session].ECSSubnet = ecsSubnet
 					}
-
-					dcss.Lock()
+					// Record this query's time before the strategy runs:
+					// strategies such as time-window read CurrentQueryTime
+					// to measure elapsed time, and must see the current
+					// query's timestamp rather than a stale one left over
+					// from the previous query.
 					dcss.Sessions[name.Session].CurrentQueryTime = now
 					dcss.Sessions[name.Session].LastQueryTime = now
 					dcss.Unlock()
 
-					for _, resp := range response {
+					ctx := contextWithAppConfig(contextWithStore(context.Background(), dcss), appConfig)
+					rrs, strategyErr := strategy.Answer(ctx, name.Session, q)
+					rcode := "NOERROR"
+					if strategyErr != nil {
+						rcode = "SERVFAIL"
+						log.Printf("DNS: strategy %v failed: %v\n", strategy.Name(), strategyErr)
+					} else {
+						m.Answer = append(m.Answer, rrs...)
+						log.Printf("DNS: response: %v\n", rrs)
+					}
 
-						rr, err := dns.NewRR(resp)
-						if err == nil {
-							m.Answer = append(m.Answer, rr)
-							log.Printf("DNS: response: %v\n", resp)
-						}
+					observeQuery(dns.TypeToString[q.Qtype], strategy.Name(), rcode, now, prevQueryTime)
+
+					echoECS(r, m)
+				default:
+					if len(appConfig.UpstreamResolvers) > 0 {
+						forwardUpstream(appConfig, w, r)
+						return
 					}
 				}
 			}
@@ -364,6 +659,7 @@ type HTTPServerStoreHandler struct {
 	DynamicServers []*http.Server
 	StaticServers  []*http.Server
 	Dcss           *DNSClientStateStore
+	AppConfig      *AppConfig
 }
 
 // IPTablesHandler is a HTTP handler that adds/removes iptables rules
@@ -471,7 +767,7 @@ func (hss *HTTPServerStoreHandler) ServeHTTP(w http.ResponseWriter, r *http.Requ
 		}
 		hss.Unlock()
 
-		httpServer := NewHTTPServer(port, hss, hss.Dcss)
+		httpServer := NewHTTPServer(port, hss, hss.Dcss, hss.AppConfig)
 		httpServerErr := StartHTTPServer(httpServer, hss, true)
 
 		if httpServerErr != nil {
@@ -522,9 +818,11 @@ func (ipt *IPTablesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	go func(rule *IPTablesRule) {
 		time.Sleep(time.Second * time.Duration(5))
 		ipTablesRule.RemoveRule()
+		iptablesRulesTotal.WithLabelValues("removed").Inc()
 	}(ipTablesRule)
 
 	ipTablesRule.AddRule()
+	iptablesRulesTotal.WithLabelValues("added").Inc()
 
 	//Instead of writing the beginning of a valid HTTP response
 	// e.g. bufrw.WriteString("HTTP")
@@ -563,7 +861,7 @@ func (h *DelayDOMLoadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 }
 
 // NewHTTPServer configures a HTTP server
-func NewHTTPServer(port int, hss *HTTPServerStoreHandler, dcss *DNSClientStateStore) *http.Server {
+func NewHTTPServer(port int, hss *HTTPServerStoreHandler, dcss *DNSClientStateStore, appConfig *AppConfig) *http.Server {
 	d := &DefaultHeadersHandler{NextHandler: http.FileServer(http.Dir("./html"))}
 	ipth := &IPTablesHandler{}
 	delayDOMLoadHandler := &DelayDOMLoadHandler{}
@@ -608,6 +906,13 @@ func NewHTTPServer(port int, hss *HTTPServerStoreHandler, dcss *DNSClientStateSt
 
 	h.Handle("/servers", hss)
 	h.Handle("/delaydomload", delayDOMLoadHandler)
+	h.Handle("/metrics", metricsHandler(dcss))
+	h.Handle("/sessions", &SessionsHandler{Dcss: dcss})
+	h.Handle("/sessions/", &SessionsHandler{Dcss: dcss})
+
+	if appConfig != nil && appConfig.DoHPath != "" {
+		h.Handle(appConfig.DoHPath, &DoHHandler{Handler: MakeRebindDNSHandler(appConfig, dcss)})
+	}
 
 	httpServer := &http.Server{Addr: ":" + strconv.Itoa(port), Handler: h}
 
@@ -655,9 +960,12 @@ func StartHTTPServer(s *http.Server, hss *HTTPServerStoreHandler, dynamic bool)
 
 	hss.Unlock()
 
+	httpServerUp.WithLabelValues(s.Addr).Set(1)
+
 	go func() {
 		log.Printf("HTTP: starting HTTP Server on %v\n", s.Addr)
 		routineErr := s.Serve(l)
+		httpServerUp.WithLabelValues(s.Addr).Set(0)
 		hss.Errc <- HTTPServerError{Err: routineErr, Port: s.Addr}
 	}()
 
@@ -668,5 +976,6 @@ func StartHTTPServer(s *http.Server, hss *HTTPServerStoreHandler, dynamic bool)
 // StopHTTPServer stops an HTTP server
 func StopHTTPServer(s *http.Server, hss *HTTPServerStoreHandler) {
 	log.Printf("HTTP: stopping HTTP Server on %v\n", s.Addr)
+	httpServerUp.WithLabelValues(s.Addr).Set(0)
 	s.Close()
 }
